@@ -2,25 +2,36 @@ package main
 
 import (
 	"bytes"
+	"crypto/rsa"
 	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/Masterminds/sprig"
+	"github.com/dgrijalva/jwt-go"
 	"github.com/google/go-github/v34/github"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
+	"sigs.k8s.io/yaml"
 )
 
+// installationTokenRefreshSkew is subtracted from a reported token expiry
+// so in-flight requests never race an expired token.
+const installationTokenRefreshSkew = 60 * time.Second
+
 func newRoundTripper(accessToken string, insecure bool) http.RoundTripper {
 	// Reuse default transport that has timeouts and supports proxies
 	transport := http.DefaultTransport.(*http.Transport)
@@ -38,30 +49,350 @@ func (rt roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
 	return rt.underlying.RoundTrip(r)
 }
 
+// appInstallationRoundTripper authenticates as a GitHub App installation
+// instead of a static token, refreshing the installation token as needed.
+type appInstallationRoundTripper struct {
+	appID          int64
+	installationID int64
+	privateKey     *rsa.PrivateKey
+	apiBaseURL     string
+	underlying     http.RoundTripper
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func newAppInstallationRoundTripper(appID, installationID int64, privateKeyPEM []byte, baseURL string, insecure bool) (*appInstallationRoundTripper, error) {
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(privateKeyPEM)
+	if err != nil {
+		return nil, errors.WithMessage(err, "-private-key or -private-key-file is not a valid RSA private key")
+	}
+
+	apiBaseURL := strings.TrimSuffix(baseURL, "/")
+	if apiBaseURL == "" {
+		apiBaseURL = "https://api.github.com"
+	}
+
+	// Reuse default transport that has timeouts and supports proxies
+	transport := http.DefaultTransport.(*http.Transport)
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: insecure}
+
+	return &appInstallationRoundTripper{
+		appID:          appID,
+		installationID: installationID,
+		privateKey:     key,
+		apiBaseURL:     apiBaseURL,
+		underlying:     transport,
+	}, nil
+}
+
+func (rt *appInstallationRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	token, err := rt.installationToken()
+	if err != nil {
+		return nil, err
+	}
+
+	r.Header.Set("Authorization", fmt.Sprintf("token %s", token))
+	return rt.underlying.RoundTrip(r)
+}
+
+func (rt *appInstallationRoundTripper) installationToken() (string, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if rt.token != "" && time.Now().Before(rt.expiresAt) {
+		return rt.token, nil
+	}
+
+	token, expiresAt, err := rt.fetchInstallationToken()
+	if err != nil {
+		return "", err
+	}
+
+	rt.token = token
+	rt.expiresAt = expiresAt
+	return rt.token, nil
+}
+
+func (rt *appInstallationRoundTripper) fetchInstallationToken() (string, time.Time, error) {
+	appJWT, err := rt.signAppJWT()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", rt.apiBaseURL, rt.installationID)
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", appJWT))
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+
+	resp, err := rt.underlying.RoundTrip(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", time.Time{}, errors.Errorf("github-commenter: Error creating installation access token: %s: %s", resp.Status, string(body))
+	}
+
+	var result struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return result.Token, result.ExpiresAt.Add(-installationTokenRefreshSkew), nil
+}
+
+func (rt *appInstallationRoundTripper) signAppJWT() (string, error) {
+	now := time.Now()
+	claims := jwt.StandardClaims{
+		IssuedAt:  now.Add(-30 * time.Second).Unix(),
+		ExpiresAt: now.Add(9 * time.Minute).Unix(),
+		Issuer:    strconv.FormatInt(rt.appID, 10),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	return token.SignedString(rt.privateKey)
+}
+
+func envInt(key string, def int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return def
+	}
+	return i
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
 var (
 	token              = flag.String("token", os.Getenv("GITHUB_TOKEN"), "Github access token")
+	appID              = flag.String("app-id", os.Getenv("GITHUB_APP_ID"), "GitHub App ID. Authenticates as a GitHub App installation instead of -token; requires -installation-id and -private-key(-file)")
+	installationID     = flag.String("installation-id", os.Getenv("GITHUB_APP_INSTALLATION_ID"), "GitHub App installation ID")
+	privateKey         = flag.String("private-key", os.Getenv("GITHUB_APP_PRIVATE_KEY"), "GitHub App private key (PEM), as a string. Use either -private-key or -private-key-file")
+	privateKeyFile     = flag.String("private-key-file", os.Getenv("GITHUB_APP_PRIVATE_KEY_FILE"), "Path to a GitHub App private key (PEM) file. Use either -private-key or -private-key-file")
 	owner              = flag.String("owner", os.Getenv("GITHUB_OWNER"), "Github repository owner")
 	repo               = flag.String("repo", os.Getenv("GITHUB_REPO"), "Github repository name")
-	commentType        = flag.String("type", os.Getenv("GITHUB_COMMENT_TYPE"), "Comment type: 'commit', 'pr', 'issue', 'pr-review' or 'pr-file'")
+	commentType        = flag.String("type", os.Getenv("GITHUB_COMMENT_TYPE"), "Comment type: 'commit', 'pr', 'issue', 'pr-review', 'pr-file', 'pr-review-reply' or 'pr-review-batch'")
 	sha                = flag.String("sha", os.Getenv("GITHUB_COMMIT_SHA"), "Commit SHA")
 	number             = flag.String("number", os.Getenv("GITHUB_PR_ISSUE_NUMBER"), "Pull Request or Issue number")
 	file               = flag.String("file", os.Getenv("GITHUB_PR_FILE"), "Pull Request File Name")
-	position           = flag.String("position", os.Getenv("GITHUB_PR_FILE_POSITION"), "Position in Pull Request File")
+	position           = flag.String("position", os.Getenv("GITHUB_PR_FILE_POSITION"), "Position in Pull Request File. Ignored when -line is set")
+	line               = flag.String("line", os.Getenv("GITHUB_PR_FILE_LINE"), "Line of the blob in the pull request diff that the comment applies to. When set, -position becomes optional and the comment is posted using GitHub's line-based review comment API")
+	startLine          = flag.String("start-line", os.Getenv("GITHUB_PR_FILE_START_LINE"), "First line in the range of lines a multi-line comment applies to. Requires -line to be set")
+	side               = flag.String("side", os.Getenv("GITHUB_PR_FILE_SIDE"), "Side of the diff that -line refers to: 'LEFT' or 'RIGHT'. Defaults to 'RIGHT'")
+	startSide          = flag.String("start-side", os.Getenv("GITHUB_PR_FILE_START_SIDE"), "Side of the diff that -start-line refers to: 'LEFT' or 'RIGHT'. Defaults to the value of -side")
+	inReplyTo          = flag.String("in-reply-to", os.Getenv("GITHUB_PR_FILE_IN_REPLY_TO"), "Comment ID of an existing PR review comment to reply to. Creates a threaded reply instead of a top-level file comment. Supported for comment types 'pr-file' and 'pr-review-reply'")
+	inReplyToRegex     = flag.String("in-reply-to-regex", os.Getenv("GITHUB_PR_FILE_IN_REPLY_TO_REGEX"), "Regex to find an existing PR review comment to reply to. The first match is used as the parent of a threaded reply. Alternative to -in-reply-to")
 	templ              = flag.String("template", os.Getenv("GITHUB_COMMENT_TEMPLATE"), "Template to format comment. Supports `Go` templates: My comment:<br/>{{.}}. Use either `template` or `template_file`")
 	templateFile       = flag.String("template_file", os.Getenv("GITHUB_COMMENT_TEMPLATE_FILE"), "The path to a template file to format comment. Supports `Go` templates. Use either `template` or `template_file`")
 	format             = flag.String("format", os.Getenv("GITHUB_COMMENT_FORMAT"), "Alias of `template`")
 	formatFile         = flag.String("format_file", os.Getenv("GITHUB_COMMENT_FORMAT_FILE"), "Alias of `template_file`")
 	comment            = flag.String("comment", os.Getenv("GITHUB_COMMENT"), "Comment text")
+	reportFile         = flag.String("report-file", os.Getenv("GITHUB_REPORT_FILE"), "Path to a JSON or YAML report describing a batch of PR review comments. Read from 'stdin' if not set. Used by comment type 'pr-review-batch'")
 	deleteCommentRegex = flag.String("delete-comment-regex", os.Getenv("GITHUB_DELETE_COMMENT_REGEX"), "Regex to find previous comments to delete before creating the new comment. Supported for comment types `commit`, `pr-file`, `issue` and `pr`")
 	editCommentRegex   = flag.String("edit-comment-regex", os.Getenv("GITHUB_EDIT_COMMENT_REGEX"), "Regex to find previous comments to replace with new content, or create new comment if none found. Supported for comment types `commit`, `pr-file`, `issue` and `pr`")
+	fingerprint        = flag.String("fingerprint", os.Getenv("GITHUB_FINGERPRINT"), "Stable key identifying this comment across runs. Embeds a hidden `<!-- github-commenter:fp=<key> -->` marker in the comment body and, on later runs, matches previous comments by that marker instead of `-delete-comment-regex`/`-edit-comment-regex`. Supported for comment types `commit`, `pr-file`, `issue` and `pr`")
 	baseURL            = flag.String("baseURL", os.Getenv("GITHUB_BASE_URL"), "Base URL of github enterprise")
 	uploadURL          = flag.String("uploadURL", os.Getenv("GITHUB_UPLOAD_URL"), "Upload URL of github enterprise")
 	insecure           = flag.Bool("insecure", strings.ToLower(os.Getenv("GITHUB_INSECURE")) == "true", "Ignore SSL certificate check")
 	useCommitShaforPR  = flag.Bool("use-sha-for-pr", strings.ToLower(os.Getenv("GITHUB_USE_SHA_FOR_PR")) == "true", "Use commit sha to find PR number")
 	state              = flag.String("pr-state", os.Getenv("GITHUB_PR_STATE"), "State of the PR e.g closed,open. Default is open")
 	baseBranch         = flag.String("base-branch", os.Getenv("GITHUB_PR_BASE_BRANCH"), "Base branch of pull request")
+	maxRetries         = flag.Int("max-retries", envInt("GITHUB_MAX_RETRIES", 5), "Maximum number of retries for a GitHub API call that fails with a 5xx error, using jittered exponential backoff")
+	maxWait            = flag.Duration("max-wait", envDuration("GITHUB_MAX_WAIT", 5*time.Minute), "Maximum time to sleep while waiting out a rate limit (primary or secondary) before giving up")
 )
 
+// rateLimitWait returns how long to sleep before retrying a rate-limited
+// (403/429) response. The bool is false when resp isn't a 403/429, or is one
+// without a numeric Retry-After or an X-RateLimit-Remaining of 0 with a
+// numeric X-RateLimit-Reset.
+func rateLimitWait(resp *github.Response) (time.Duration, bool) {
+	if resp == nil || resp.Response == nil {
+		return 0, false
+	}
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		if secs, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset := resp.Header.Get("X-RateLimit-Reset"); reset != "" {
+			if epoch, err := strconv.ParseInt(reset, 10, 64); err == nil {
+				wait := time.Until(time.Unix(epoch, 0))
+				if wait < 0 {
+					wait = 0
+				}
+				return wait, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+func jitteredBackoff(attempt int) time.Duration {
+	base := time.Duration(1<<uint(attempt)) * time.Second
+	if base > 30*time.Second {
+		base = 30 * time.Second
+	}
+	return base/2 + time.Duration(rand.Int63n(int64(base)/2+1))
+}
+
+// withRetry runs op, which must be idempotent since it may be called more
+// than once: it's retried up to -max-retries times on a 5xx with jittered
+// backoff, and rate limits (403/429) are waited out up to -max-wait.
+func withRetry(op func() (*github.Response, error)) error {
+	var lastErr error
+	for attempt := 0; attempt <= *maxRetries; attempt++ {
+		resp, err := op()
+
+		if wait, limited := rateLimitWait(resp); limited {
+			if wait > *maxWait {
+				return errors.Errorf("github-commenter: rate limited, and the reset wait (%s) exceeds -max-wait (%s)", wait, *maxWait)
+			}
+			if attempt == *maxRetries {
+				return errors.Errorf("github-commenter: still rate limited after -max-retries (%d) retries", *maxRetries)
+			}
+			log.Println("github-commenter: Rate limited, waiting", wait, "before retrying")
+			time.Sleep(wait)
+			continue
+		}
+
+		if err == nil || resp == nil || resp.StatusCode < 500 || attempt == *maxRetries {
+			return err
+		}
+
+		lastErr = err
+		backoff := jitteredBackoff(attempt)
+		log.Println("github-commenter: Error calling GitHub API, retrying in", backoff, ":", err)
+		time.Sleep(backoff)
+	}
+
+	return lastErr
+}
+
+// withRateLimitRetry is withRetry without the 5xx retry, for non-idempotent
+// calls (creates) where a retried 5xx could double-post.
+func withRateLimitRetry(op func() (*github.Response, error)) error {
+	for attempt := 0; ; attempt++ {
+		resp, err := op()
+
+		wait, limited := rateLimitWait(resp)
+		if !limited {
+			return err
+		}
+		if wait > *maxWait {
+			return errors.Errorf("github-commenter: rate limited, and the reset wait (%s) exceeds -max-wait (%s)", wait, *maxWait)
+		}
+		if attempt == *maxRetries {
+			return errors.Errorf("github-commenter: still rate limited after -max-retries (%d) retries", *maxRetries)
+		}
+		log.Println("github-commenter: Rate limited, waiting", wait, "before retrying")
+		time.Sleep(wait)
+	}
+}
+
+// listAllCommitComments pages through every commit comment on sha.
+func listAllCommitComments(githubClient *github.Client, sha string) ([]*github.RepositoryComment, error) {
+	var all []*github.RepositoryComment
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		var page []*github.RepositoryComment
+		var resp *github.Response
+		err := withRetry(func() (*github.Response, error) {
+			var e error
+			page, resp, e = githubClient.Repositories.ListCommitComments(context.Background(), *owner, *repo, sha, opts)
+			return resp, e
+		})
+		if err != nil {
+			return all, err
+		}
+		all = append(all, page...)
+		if resp.NextPage == 0 {
+			return all, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// listAllIssueComments pages through every comment on issue/PR num.
+func listAllIssueComments(githubClient *github.Client, num int) ([]*github.IssueComment, error) {
+	var all []*github.IssueComment
+	opts := &github.IssueListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		var page []*github.IssueComment
+		var resp *github.Response
+		err := withRetry(func() (*github.Response, error) {
+			var e error
+			page, resp, e = githubClient.Issues.ListComments(context.Background(), *owner, *repo, num, opts)
+			return resp, e
+		})
+		if err != nil {
+			return all, err
+		}
+		all = append(all, page...)
+		if resp.NextPage == 0 {
+			return all, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// listAllPullRequestComments pages through every review comment on PR num.
+func listAllPullRequestComments(githubClient *github.Client, num int) ([]*github.PullRequestComment, error) {
+	var all []*github.PullRequestComment
+	opts := &github.PullRequestListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		var page []*github.PullRequestComment
+		var resp *github.Response
+		err := withRetry(func() (*github.Response, error) {
+			var e error
+			page, resp, e = githubClient.PullRequests.ListComments(context.Background(), *owner, *repo, num, opts)
+			return resp, e
+		})
+		if err != nil {
+			return all, err
+		}
+		all = append(all, page...)
+		if resp.NextPage == 0 {
+			return all, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
 func getPullRequestOrIssueNumber(str string) (int, error) {
 	if str == "" {
 		return 0, errors.New("-number or GITHUB_PR_ISSUE_NUMBER required")
@@ -83,13 +414,49 @@ func getPullRequestNumberFromSha( sha, state, base string, client *github.Client
 		State: state,
 		Base: base,
 	}
-	pullRequests,_,err :=  pullRequestsService.ListPullRequestsWithCommit(context.Background(), *owner, *repo, sha, opts, )
+	var pullRequests []*github.PullRequest
+	err := withRetry(func() (*github.Response, error) {
+		var e error
+		var resp *github.Response
+		pullRequests, resp, e = pullRequestsService.ListPullRequestsWithCommit(context.Background(), *owner, *repo, sha, opts)
+		return resp, e
+	})
 	if err !=nil {
 		return 0, err
 	}
 	return *pullRequests[0].Number, nil
 }
 
+// resolveInReplyTo returns the parent comment ID for a threaded reply, from
+// -in-reply-to or the first PR comment matching -in-reply-to-regex.
+func resolveInReplyTo(githubClient *github.Client, num int) (int64, error) {
+	if *inReplyTo != "" {
+		id, err := strconv.ParseInt(*inReplyTo, 10, 64)
+		if err != nil {
+			return 0, errors.WithMessage(err, "-in-reply-to or GITHUB_PR_FILE_IN_REPLY_TO must be an integer")
+		}
+		return id, nil
+	}
+
+	r, err := regexp.Compile(*inReplyToRegex)
+	if err != nil {
+		return 0, err
+	}
+
+	comments, err := listAllPullRequestComments(githubClient, num)
+	if err != nil {
+		return 0, errors.WithMessage(err, "github-commenter: Error listing PR file comments")
+	}
+
+	for _, comment := range comments {
+		if r.MatchString(*comment.Body) {
+			return *comment.ID, nil
+		}
+	}
+
+	return 0, errors.New("-in-reply-to-regex or GITHUB_PR_FILE_IN_REPLY_TO_REGEX did not match any existing PR review comment")
+}
+
 func getPullRequestFilePosition(str string) (int, error) {
 	if str == "" {
 		return 0, errors.New("-position or GITHUB_PR_FILE_POSITION required")
@@ -103,6 +470,32 @@ func getPullRequestFilePosition(str string) (int, error) {
 	return position, nil
 }
 
+// getPullRequestFileLine returns nil, nil when str is empty.
+func getPullRequestFileLine(flagName, str string) (*int, error) {
+	if str == "" {
+		return nil, nil
+	}
+
+	line, err := strconv.Atoi(str)
+	if err != nil {
+		return nil, errors.WithMessage(err, fmt.Sprintf("-%s must be an integer", flagName))
+	}
+
+	return &line, nil
+}
+
+func getAppPrivateKey() ([]byte, error) {
+	if *privateKeyFile != "" {
+		data, err := ioutil.ReadFile(*privateKeyFile)
+		if err != nil {
+			return nil, errors.WithMessage(err, "-private-key-file could not be read")
+		}
+		return data, nil
+	}
+
+	return []byte(*privateKey), nil
+}
+
 func getComment() (string, error) {
 	// Read the comment from the command-line argument or ENV var first
 	if *comment != "" {
@@ -118,6 +511,61 @@ func getComment() (string, error) {
 	return string(data), nil
 }
 
+// reviewReport is the JSON or YAML document consumed by comment type
+// 'pr-review-batch'.
+type reviewReport struct {
+	Body     string                `json:"body"`
+	Event    string                `json:"event"`
+	Comments []reviewReportComment `json:"comments"`
+}
+
+type reviewReportComment struct {
+	Path      string `json:"path"`
+	Line      int    `json:"line"`
+	StartLine int    `json:"start_line"`
+	Side      string `json:"side"`
+	StartSide string `json:"start_side"`
+	Body      string `json:"body"`
+}
+
+func getReport() ([]byte, error) {
+	// Read the report from a file on disk first
+	if *reportFile != "" {
+		data, err := ioutil.ReadFile(*reportFile)
+		if err != nil {
+			return nil, errors.WithMessage(err, "-report-file could not be read")
+		}
+		return data, nil
+	}
+
+	// Read from stdin
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Report must be provided either as '-report-file' or from 'stdin'")
+	}
+
+	return data, nil
+}
+
+func fingerprintMarker(key string) string {
+	return fmt.Sprintf("<!-- github-commenter:fp=%s -->", key)
+}
+
+func addFingerprint(body string) string {
+	if *fingerprint == "" {
+		return body
+	}
+	return body + "\n" + fingerprintMarker(*fingerprint)
+}
+
+// findCommentRegex returns userRegex, or the -fingerprint marker regex if set.
+func findCommentRegex(userRegex string) (*regexp.Regexp, error) {
+	if *fingerprint != "" {
+		return regexp.Compile(regexp.QuoteMeta(fingerprintMarker(*fingerprint)))
+	}
+	return regexp.Compile(userRegex)
+}
+
 func formatComment(comment string) (string, error) {
 	if *format == "" && *formatFile == "" && *templ == "" && *templateFile == "" {
 		return comment, nil
@@ -170,7 +618,17 @@ func formatComment(comment string) (string, error) {
 func main() {
 	flag.Parse()
 
-	if *token == "" {
+	usingGitHubApp := *appID != "" || *installationID != "" || *privateKey != "" || *privateKeyFile != ""
+	if *token != "" && usingGitHubApp {
+		flag.PrintDefaults()
+		log.Fatal("-token cannot be used together with -app-id/-installation-id/-private-key(-file); choose one authentication method")
+	}
+	if usingGitHubApp {
+		if *appID == "" || *installationID == "" || (*privateKey == "" && *privateKeyFile == "") {
+			flag.PrintDefaults()
+			log.Fatal("-app-id, -installation-id and -private-key (or -private-key-file) are all required for GitHub App authentication")
+		}
+	} else if *token == "" {
 		flag.PrintDefaults()
 		log.Fatal("-token or GITHUB_TOKEN required")
 	}
@@ -186,12 +644,39 @@ func main() {
 		flag.PrintDefaults()
 		log.Fatal("-type or GITHUB_COMMENT_TYPE required")
 	}
-	if *commentType != "commit" && *commentType != "pr" && *commentType != "issue" && *commentType != "pr-review" && *commentType != "pr-file" {
+	if *commentType != "commit" && *commentType != "pr" && *commentType != "issue" && *commentType != "pr-review" && *commentType != "pr-file" && *commentType != "pr-review-reply" && *commentType != "pr-review-batch" {
 		flag.PrintDefaults()
-		log.Fatal("-type or GITHUB_COMMENT_TYPE must be one of 'commit', 'pr', 'issue', 'pr-review' or 'pr-file'")
+		log.Fatal("-type or GITHUB_COMMENT_TYPE must be one of 'commit', 'pr', 'issue', 'pr-review', 'pr-file', 'pr-review-reply' or 'pr-review-batch'")
 	}
+	if *commentType == "pr-review-reply" && *inReplyTo == "" && *inReplyToRegex == "" {
+		flag.PrintDefaults()
+		log.Fatal("-in-reply-to or -in-reply-to-regex required for comment type 'pr-review-reply'")
+	}
+
+	if usingGitHubApp {
+		appIDInt, err := strconv.ParseInt(*appID, 10, 64)
+		if err != nil {
+			log.Fatal(errors.WithMessage(err, "-app-id or GITHUB_APP_ID must be an integer"))
+		}
 
-	http.DefaultClient.Transport = newRoundTripper(*token, *insecure)
+		installationIDInt, err := strconv.ParseInt(*installationID, 10, 64)
+		if err != nil {
+			log.Fatal(errors.WithMessage(err, "-installation-id or GITHUB_APP_INSTALLATION_ID must be an integer"))
+		}
+
+		privateKeyPEM, err := getAppPrivateKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		rt, err := newAppInstallationRoundTripper(appIDInt, installationIDInt, privateKeyPEM, *baseURL, *insecure)
+		if err != nil {
+			log.Fatal(err)
+		}
+		http.DefaultClient.Transport = rt
+	} else {
+		http.DefaultClient.Transport = newRoundTripper(*token, *insecure)
+	}
 
 	var githubClient *github.Client
 	if *baseURL != "" || *uploadURL != "" {
@@ -225,27 +710,34 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		formattedComment = addFingerprint(formattedComment)
 		commitComment := &github.RepositoryComment{Body: &formattedComment}
 
-		// Find and delete existing comment(s) before creating the new one
+		// Find and delete existing comment(s) before creating the new one.
+		// Skipped when only -fingerprint is set: -fingerprint's edit pass
+		// below already updates a matching comment in place, and deleting
+		// it first would just force a delete-then-recreate instead of a
+		// quiet edit.
 		if *deleteCommentRegex != "" {
-			r, err := regexp.Compile(*deleteCommentRegex)
+			r, err := findCommentRegex(*deleteCommentRegex)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			listOptions := &github.ListOptions{}
-			comments, _, err := githubClient.Repositories.ListCommitComments(context.Background(), *owner, *repo, *sha, listOptions)
+			comments, err := listAllCommitComments(githubClient, *sha)
 			if err != nil {
 				log.Println("github-commenter: Error listing commit comments: ", err)
 			} else {
 				for _, comment := range comments {
 					if r.MatchString(*comment.Body) {
-						_, err = githubClient.Repositories.DeleteComment(context.Background(), *owner, *repo, *comment.ID)
+						commentID := *comment.ID
+						err := withRetry(func() (*github.Response, error) {
+							return githubClient.Repositories.DeleteComment(context.Background(), *owner, *repo, commentID)
+						})
 						if err != nil {
 							log.Println("github-commenter: Error deleting commit comment: ", err)
 						} else {
-							log.Println("github-commenter: Deleted commit comment: ", *comment.ID)
+							log.Println("github-commenter: Deleted commit comment: ", commentID)
 						}
 					}
 				}
@@ -253,26 +745,29 @@ func main() {
 		}
 
 		// Find and update existing comment with new content
-		if *editCommentRegex != "" {
+		if *editCommentRegex != "" || *fingerprint != "" {
 			found := false
-			r, err := regexp.Compile(*editCommentRegex)
+			r, err := findCommentRegex(*editCommentRegex)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			listOptions := &github.ListOptions{}
-			comments, _, err := githubClient.Repositories.ListCommitComments(context.Background(), *owner, *repo, *sha, listOptions)
+			comments, err := listAllCommitComments(githubClient, *sha)
 			if err != nil {
 				log.Println("github-commenter: Error listing commit comments: ", err)
 			} else {
 				for _, comment := range comments {
 					if r.MatchString(*comment.Body) {
 						found = true
-						_, _, err = githubClient.Repositories.UpdateComment(context.Background(), *owner, *repo, *comment.ID, commitComment)
+						commentID := *comment.ID
+						err := withRetry(func() (*github.Response, error) {
+							_, resp, e := githubClient.Repositories.UpdateComment(context.Background(), *owner, *repo, commentID, commitComment)
+							return resp, e
+						})
 						if err != nil {
 							log.Fatal("github-commenter: Error updating commit comment: ", err)
 						} else {
-							log.Println("github-commenter: Updated commit comment: ", *comment.ID)
+							log.Println("github-commenter: Updated commit comment: ", commentID)
 						}
 					}
 				}
@@ -282,7 +777,12 @@ func main() {
 			}
 		}
 
-		commitComment, _, err = githubClient.Repositories.CreateComment(context.Background(), *owner, *repo, *sha, commitComment)
+		err = withRateLimitRetry(func() (*github.Response, error) {
+			var resp *github.Response
+			var e error
+			commitComment, resp, e = githubClient.Repositories.CreateComment(context.Background(), *owner, *repo, *sha, commitComment)
+			return resp, e
+		})
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -324,7 +824,13 @@ func main() {
 		}
 
 		pullRequestReviewRequest := &github.PullRequestReviewRequest{Body: &formattedComment, Event: github.String("COMMENT")}
-		pullRequestReview, _, err := githubClient.PullRequests.CreateReview(context.Background(), *owner, *repo, prNumber, pullRequestReviewRequest)
+		var pullRequestReview *github.PullRequestReview
+		err = withRateLimitRetry(func() (*github.Response, error) {
+			var resp *github.Response
+			var e error
+			pullRequestReview, resp, e = githubClient.PullRequests.CreateReview(context.Background(), *owner, *repo, prNumber, pullRequestReviewRequest)
+			return resp, e
+		})
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -346,53 +852,63 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		formattedComment = addFingerprint(formattedComment)
 		issueComment := &github.IssueComment{Body: &formattedComment}
 
-		// Find and delete existing comment(s) before creating the new one
+		// Find and delete existing comment(s) before creating the new one.
+		// Skipped when only -fingerprint is set: -fingerprint's edit pass
+		// below already updates a matching comment in place, and deleting
+		// it first would just force a delete-then-recreate instead of a
+		// quiet edit.
 		if *deleteCommentRegex != "" {
-			r, err := regexp.Compile(*deleteCommentRegex)
+			r, err := findCommentRegex(*deleteCommentRegex)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			listOptions := &github.IssueListCommentsOptions{}
-			comments, _, err := githubClient.Issues.ListComments(context.Background(), *owner, *repo, num, listOptions)
+			comments, err := listAllIssueComments(githubClient, num)
 			if err != nil {
 				log.Println("github-commenter: Error listing Issue/PR comments: ", err)
 			} else {
 				for _, comment := range comments {
 					if r.MatchString(*comment.Body) {
-						_, err = githubClient.Issues.DeleteComment(context.Background(), *owner, *repo, *comment.ID)
+						commentID := *comment.ID
+						err := withRetry(func() (*github.Response, error) {
+							return githubClient.Issues.DeleteComment(context.Background(), *owner, *repo, commentID)
+						})
 						if err != nil {
 							log.Println("github-commenter: Error deleting Issue/PR comment: ", err)
 						} else {
-							log.Println("github-commenter: Deleted Issue/PR comment: ", *comment.ID)
+							log.Println("github-commenter: Deleted Issue/PR comment: ", commentID)
 						}
 					}
 				}
 			}
 		}
 		// Find and update existing comment(s) with new content
-		if *editCommentRegex != "" {
+		if *editCommentRegex != "" || *fingerprint != "" {
 			found := false
-			r, err := regexp.Compile(*editCommentRegex)
+			r, err := findCommentRegex(*editCommentRegex)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			listOptions := &github.IssueListCommentsOptions{}
-			comments, _, err := githubClient.Issues.ListComments(context.Background(), *owner, *repo, num, listOptions)
+			comments, err := listAllIssueComments(githubClient, num)
 			if err != nil {
 				log.Println("github-commenter: Error listing Issue/PR comments: ", err)
 			} else {
 				for _, comment := range comments {
 					if r.MatchString(*comment.Body) {
 						found = true
-						_, _, err = githubClient.Issues.EditComment(context.Background(), *owner, *repo, *comment.ID, issueComment)
+						commentID := *comment.ID
+						err := withRetry(func() (*github.Response, error) {
+							_, resp, e := githubClient.Issues.EditComment(context.Background(), *owner, *repo, commentID, issueComment)
+							return resp, e
+						})
 						if err != nil {
 							log.Fatal("github-commenter: Error updating Issue/PR comment: ", err)
 						} else {
-							log.Println("github-commenter: Updated Issue/PR comment: ", *comment.ID)
+							log.Println("github-commenter: Updated Issue/PR comment: ", commentID)
 						}
 					}
 				}
@@ -402,7 +918,12 @@ func main() {
 			}
 		}
 
-		issueComment, _, err = githubClient.Issues.CreateComment(context.Background(), *owner, *repo, num, issueComment)
+		err = withRateLimitRetry(func() (*github.Response, error) {
+			var resp *github.Response
+			var e error
+			issueComment, resp, e = githubClient.Issues.CreateComment(context.Background(), *owner, *repo, num, issueComment)
+			return resp, e
+		})
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -425,9 +946,54 @@ func main() {
 			log.Fatal("-file or GITHUB_PR_FILE required")
 		}
 
-		position, err := getPullRequestFilePosition(*position)
-		if err != nil {
-			log.Fatal(err)
+		var parentCommentID *int64
+		if *inReplyTo != "" || *inReplyToRegex != "" {
+			id, err := resolveInReplyTo(githubClient, num)
+			if err != nil {
+				log.Fatal(err)
+			}
+			parentCommentID = &id
+		}
+
+		var filePosition, fileLine, fileStartLine *int
+		var fileSide, fileStartSide *string
+		if parentCommentID == nil {
+			if *line != "" {
+				fileLine, err = getPullRequestFileLine("line", *line)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				fileStartLine, err = getPullRequestFileLine("start-line", *startLine)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				if *side != "" {
+					fileSide = side
+				} else {
+					fileSide = github.String("RIGHT")
+				}
+
+				if fileStartLine != nil {
+					if *startSide != "" {
+						fileStartSide = startSide
+					} else {
+						fileStartSide = fileSide
+					}
+				}
+			} else {
+				if *startLine != "" || *side != "" || *startSide != "" {
+					flag.PrintDefaults()
+					log.Fatal("-start-line, -side and -start-side require -line to be set")
+				}
+
+				pos, err := getPullRequestFilePosition(*position)
+				if err != nil {
+					log.Fatal(err)
+				}
+				filePosition = &pos
+			}
 		}
 
 		comment, err := getComment()
@@ -439,27 +1005,44 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		pullRequestComment := &github.PullRequestComment{Body: &formattedComment, Path: file, Position: &position, CommitID: sha}
+		formattedComment = addFingerprint(formattedComment)
+		pullRequestComment := &github.PullRequestComment{
+			Body:      &formattedComment,
+			Path:      file,
+			Position:  filePosition,
+			Line:      fileLine,
+			StartLine: fileStartLine,
+			Side:      fileSide,
+			StartSide: fileStartSide,
+			CommitID:  sha,
+			InReplyTo: parentCommentID,
+		}
 
-		// Find and delete existing comment(s) before creating the new one
+		// Find and delete existing comment(s) before creating the new one.
+		// Skipped when only -fingerprint is set: -fingerprint's edit pass
+		// below already updates a matching comment in place, and deleting
+		// it first would just force a delete-then-recreate instead of a
+		// quiet edit.
 		if *deleteCommentRegex != "" {
-			r, err := regexp.Compile(*deleteCommentRegex)
+			r, err := findCommentRegex(*deleteCommentRegex)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			listOptions := &github.PullRequestListCommentsOptions{}
-			comments, _, err := githubClient.PullRequests.ListComments(context.Background(), *owner, *repo, num, listOptions)
+			comments, err := listAllPullRequestComments(githubClient, num)
 			if err != nil {
 				log.Println("github-commenter: Error listing PR file comments: ", err)
 			} else {
 				for _, comment := range comments {
 					if r.MatchString(*comment.Body) {
-						_, err = githubClient.PullRequests.DeleteComment(context.Background(), *owner, *repo, *comment.ID)
+						commentID := *comment.ID
+						err := withRetry(func() (*github.Response, error) {
+							return githubClient.PullRequests.DeleteComment(context.Background(), *owner, *repo, commentID)
+						})
 						if err != nil {
 							log.Println("github-commenter: Error deleting PR file comment: ", err)
 						} else {
-							log.Println("github-commenter: Deleted PR file comment: ", *comment.ID)
+							log.Println("github-commenter: Deleted PR file comment: ", commentID)
 						}
 					}
 				}
@@ -467,9 +1050,9 @@ func main() {
 		}
 
 		// Find and update existing comment with new content
-		if *editCommentRegex != "" {
+		if *editCommentRegex != "" || *fingerprint != "" {
 			found := false
-			r, err := regexp.Compile(*editCommentRegex)
+			r, err := findCommentRegex(*editCommentRegex)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -478,19 +1061,22 @@ func main() {
 			// The API call will fail if the req includes other fields (path, commit_id, position)
 			editComment := &github.PullRequestComment{Body: pullRequestComment.Body}
 
-			listOptions := &github.PullRequestListCommentsOptions{}
-			comments, _, err := githubClient.PullRequests.ListComments(context.Background(), *owner, *repo, num, listOptions)
+			comments, err := listAllPullRequestComments(githubClient, num)
 			if err != nil {
 				log.Println("github-commenter: Error listing PR file commit comments: ", err)
 			} else {
 				for _, comment := range comments {
 					if r.MatchString(*comment.Body) {
 						found = true
-						_, _, err = githubClient.PullRequests.EditComment(context.Background(), *owner, *repo, *comment.ID, editComment)
+						commentID := *comment.ID
+						err := withRetry(func() (*github.Response, error) {
+							_, resp, e := githubClient.PullRequests.EditComment(context.Background(), *owner, *repo, commentID, editComment)
+							return resp, e
+						})
 						if err != nil {
 							log.Fatal("github-commenter: Error updating PR file comment: ", err)
 						} else {
-							log.Println("github-commenter: Updated PR file comment: ", *comment.ID)
+							log.Println("github-commenter: Updated PR file comment: ", commentID)
 						}
 					}
 				}
@@ -500,11 +1086,113 @@ func main() {
 			}
 		}
 
-		pullRequestComment, _, err = githubClient.PullRequests.CreateComment(context.Background(), *owner, *repo, num, pullRequestComment)
+		err = withRateLimitRetry(func() (*github.Response, error) {
+			var resp *github.Response
+			var e error
+			pullRequestComment, resp, e = githubClient.PullRequests.CreateComment(context.Background(), *owner, *repo, num, pullRequestComment)
+			return resp, e
+		})
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		log.Println("github-commenter: Created GitHub PR comment on file: ", *pullRequestComment.ID)
+	} else if *commentType == "pr-review-reply" {
+		// https://developer.github.com/v3/pulls/comments/#create-a-reply-for-a-review-comment
+		num, err := getPullRequestOrIssueNumber(*number)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		parentCommentID, err := resolveInReplyTo(githubClient, num)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		comment, err := getComment()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		formattedComment, err := formatComment(comment)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pullRequestComment := &github.PullRequestComment{Body: &formattedComment, InReplyTo: &parentCommentID}
+
+		err = withRateLimitRetry(func() (*github.Response, error) {
+			var resp *github.Response
+			var e error
+			pullRequestComment, resp, e = githubClient.PullRequests.CreateComment(context.Background(), *owner, *repo, num, pullRequestComment)
+			return resp, e
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println("github-commenter: Created GitHub PR review reply comment: ", *pullRequestComment.ID)
+	} else if *commentType == "pr-review-batch" {
+		// https://developer.github.com/v3/pulls/reviews/#create-a-pull-request-review
+		num, err := getPullRequestOrIssueNumber(*number)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		data, err := getReport()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var report reviewReport
+		if err := yaml.Unmarshal(data, &report); err != nil {
+			log.Fatal(errors.WithMessage(err, "github-commenter: Error parsing report"))
+		}
+
+		if len(report.Comments) == 0 {
+			log.Fatal("github-commenter: report must contain at least one entry in \"comments\"")
+		}
+
+		draftComments := make([]*github.DraftReviewComment, 0, len(report.Comments))
+		for _, c := range report.Comments {
+			draftComment := &github.DraftReviewComment{Path: github.String(c.Path), Body: github.String(c.Body)}
+
+			if c.StartLine != 0 {
+				draftComment.StartLine = github.Int(c.StartLine)
+				if c.StartSide != "" {
+					draftComment.StartSide = github.String(c.StartSide)
+				}
+			}
+
+			draftComment.Line = github.Int(c.Line)
+			if c.Side != "" {
+				draftComment.Side = github.String(c.Side)
+			}
+
+			draftComments = append(draftComments, draftComment)
+		}
+
+		event := report.Event
+		if event == "" {
+			event = "COMMENT"
+		}
+
+		pullRequestReviewRequest := &github.PullRequestReviewRequest{
+			Body:     github.String(report.Body),
+			Event:    github.String(event),
+			Comments: draftComments,
+		}
+
+		var pullRequestReview *github.PullRequestReview
+		err = withRateLimitRetry(func() (*github.Response, error) {
+			var resp *github.Response
+			var e error
+			pullRequestReview, resp, e = githubClient.PullRequests.CreateReview(context.Background(), *owner, *repo, num, pullRequestReviewRequest)
+			return resp, e
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println("github-commenter: Created GitHub PR review with", len(draftComments), "comment(s):", *pullRequestReview.ID)
 	}
 }